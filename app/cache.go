@@ -0,0 +1,150 @@
+package main
+
+import (
+  "strings"
+  "sync"
+  "time"
+)
+
+// cacheKey identifies a cached answer set the same way DNS itself does:
+// by the question's name, type and class.
+type cacheKey struct {
+  Name string
+  Type uint16
+  Class uint16
+}
+
+func cacheKeyFor(q Question) cacheKey {
+  return cacheKey{Name: strings.ToLower(q.Name), Type: q.Type, Class: q.Class}
+}
+
+// cacheEntry holds either a positive answer set or a negative (NXDOMAIN)
+// result, along with the TTL it was stored with and when that countdown
+// started.
+type cacheEntry struct {
+  rrs []RR
+  negative bool
+  rcode uint8
+  ttl uint32
+  storedAt time.Time
+}
+
+func (e *cacheEntry) expired(now time.Time) bool {
+  return uint32(now.Sub(e.storedAt).Seconds()) >= e.ttl
+}
+
+// cache is an in-memory positive/negative response cache keyed by
+// (name, type, class). It is safe for concurrent use.
+type cache struct {
+  mu sync.RWMutex
+  entries map[cacheKey]*cacheEntry
+  maxSize int
+  ttlCap uint32
+}
+
+func newCache(maxSize int, ttlCap uint32) *cache {
+  return &cache{
+    entries: make(map[cacheKey]*cacheEntry),
+    maxSize: maxSize,
+    ttlCap: ttlCap,
+  }
+}
+
+// get returns a cache hit for q, if any. A negative hit is reported via
+// ok=true with rcode set and rrs nil; a positive hit returns rrs with
+// their TTLs decremented by the time spent in the cache.
+func (c *cache) get(q Question) (rrs []RR, rcode uint8, ok bool) {
+  key := cacheKeyFor(q)
+  now := time.Now()
+
+  c.mu.RLock()
+  entry, found := c.entries[key]
+  c.mu.RUnlock()
+  if !found {
+    return nil, 0, false
+  }
+
+  if entry.expired(now) {
+    c.mu.Lock()
+    delete(c.entries, key)
+    c.mu.Unlock()
+    return nil, 0, false
+  }
+
+  if entry.negative {
+    return nil, entry.rcode, true
+  }
+
+  elapsed := uint32(now.Sub(entry.storedAt).Seconds())
+  rrs = make([]RR, len(entry.rrs))
+  for i, rr := range(entry.rrs) {
+    if elapsed >= rr.TTL {
+      rr.TTL = 0
+    } else {
+      rr.TTL -= elapsed
+    }
+    rrs[i] = rr
+  }
+  return rrs, 0, true
+}
+
+// putPositive caches rrs as the answer to q, capping their TTLs at
+// ttlCap when configured.
+func (c *cache) putPositive(q Question, rrs []RR) {
+  if len(rrs) == 0 {
+    return
+  }
+
+  stored := make([]RR, len(rrs))
+  copy(stored, rrs)
+  minTTL := stored[0].TTL
+  for i := range(stored) {
+    if c.ttlCap > 0 && stored[i].TTL > c.ttlCap {
+      stored[i].TTL = c.ttlCap
+    }
+    if stored[i].TTL < minTTL {
+      minTTL = stored[i].TTL
+    }
+  }
+
+  // The whole entry expires (and is evicted) once the soonest-expiring
+  // RR in it would hit zero, even though each RR's own TTL is decremented
+  // individually on every hit.
+  c.put(cacheKeyFor(q), &cacheEntry{rrs: stored, storedAt: time.Now(), ttl: minTTL})
+}
+
+// putNegative caches an NXDOMAIN (or other non-success) result for q,
+// per RFC 2308 using the zone's SOA MINIMUM as the negative TTL.
+func (c *cache) putNegative(q Question, rcode uint8, soaMinimumTTL uint32) {
+  ttl := soaMinimumTTL
+  if c.ttlCap > 0 && ttl > c.ttlCap {
+    ttl = c.ttlCap
+  }
+
+  c.put(cacheKeyFor(q), &cacheEntry{negative: true, rcode: rcode, ttl: ttl, storedAt: time.Now()})
+}
+
+func (c *cache) put(key cacheKey, entry *cacheEntry) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if c.maxSize > 0 && len(c.entries) >= c.maxSize {
+    if _, exists := c.entries[key]; !exists {
+      for evict := range(c.entries) {
+        delete(c.entries, evict)
+        break
+      }
+    }
+  }
+  c.entries[key] = entry
+}
+
+// soaMinimumTTL extracts the MINIMUM field from a SOA RR, used as the
+// negative cache TTL per RFC 2308.
+func soaMinimumTTL(rr RR) (uint32, bool) {
+  soa, ok := rr.Data.(SOARecord)
+  if !ok {
+    return 0, false
+  }
+  return soa.Minimum, true
+}
@@ -0,0 +1,23 @@
+package main
+
+// compressionContext tracks the offsets at which fully-qualified domain
+// suffixes have already been written into a message being serialized, so
+// later names can point back to them instead of repeating the labels.
+type compressionContext struct {
+  offsets map[string]uint16
+}
+
+func newCompressionContext() *compressionContext {
+  return &compressionContext{offsets: make(map[string]uint16)}
+}
+
+func (c *compressionContext) lookup(domain string) (uint16, bool) {
+  offset, ok := c.offsets[domain]
+  return offset, ok
+}
+
+func (c *compressionContext) record(domain string, offset int) {
+  if _, exists := c.offsets[domain]; !exists {
+    c.offsets[domain] = uint16(offset)
+  }
+}
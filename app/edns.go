@@ -0,0 +1,122 @@
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "io"
+)
+
+const (
+  optRRType = 41
+  edeOptionCode = 15
+
+  // serverUDPPayloadSize is the UDP payload size this server advertises
+  // back to requesters that include an OPT record.
+  serverUDPPayloadSize = 1232
+
+  // rcodeServFail is returned when an upstream forwarding attempt fails
+  // outright (as opposed to the upstream itself answering with an error).
+  rcodeServFail = 2
+
+  // ednsInfoCodeNetworkError is the RFC 8914 Extended DNS Error InfoCode
+  // reported when an upstream query couldn't be completed (timeout, dial
+  // failure, etc.).
+  ednsInfoCodeNetworkError = 23
+)
+
+// ednsOption is a single OPT pseudo-RR option (RFC 6891 section 6.1.2),
+// e.g. the Extended DNS Error option (RFC 8914).
+type ednsOption struct {
+  Code uint16
+  Data []byte
+}
+
+// EDNS0 holds the EDNS(0) metadata negotiated via an OPT record, parsed
+// from (or destined for) the additional section of a DNSMessage.
+type EDNS0 struct {
+  UDPSize uint16
+  ExtendedRCODE uint8
+  Version uint8
+  DO bool
+  Options []ednsOption
+}
+
+// rr encodes the EDNS0 back into the OPT pseudo-RR wire format it was
+// parsed from.
+func (e *EDNS0) rr() RR {
+  ttl := uint32(e.ExtendedRCODE)<<24 | uint32(e.Version)<<16
+  if e.DO {
+    ttl |= 1 << 15
+  }
+
+  data := new(bytes.Buffer)
+  for _, opt := range(e.Options) {
+    binary.Write(data, binary.BigEndian, opt.Code)
+    binary.Write(data, binary.BigEndian, uint16(len(opt.Data)))
+    data.Write(opt.Data)
+  }
+
+  return RR{
+    Name: "",
+    Type: optRRType,
+    Class: e.UDPSize,
+    TTL: ttl,
+    Data: RawRecord{Data: data.Bytes()},
+  }
+}
+
+// parseOPTRecord decodes an OPT RR (as produced by parseRR) into its
+// EDNS0 fields and options.
+func parseOPTRecord(rr RR) *EDNS0 {
+  edns := &EDNS0{
+    UDPSize: rr.Class,
+    ExtendedRCODE: uint8(rr.TTL >> 24),
+    Version: uint8(rr.TTL >> 16),
+    DO: rr.TTL&(1<<15) != 0,
+  }
+
+  raw, _ := rr.Data.(RawRecord)
+  reader := bytes.NewReader(raw.Data)
+  for reader.Len() > 0 {
+    var code, length uint16
+    if binary.Read(reader, binary.BigEndian, &code) != nil {
+      break
+    }
+    if binary.Read(reader, binary.BigEndian, &length) != nil {
+      break
+    }
+    optData := make([]byte, length)
+    if _, err := io.ReadFull(reader, optData); err != nil {
+      break
+    }
+    edns.Options = append(edns.Options, ednsOption{Code: code, Data: optData})
+  }
+
+  return edns
+}
+
+// newEDEOption builds an Extended DNS Error option (RFC 8914) reporting
+// infoCode, e.g. when an upstream forwarding failure should be surfaced to
+// the client with more detail than a bare SERVFAIL.
+func newEDEOption(infoCode uint16, extraText string) ednsOption {
+  data := make([]byte, 2+len(extraText))
+  binary.BigEndian.PutUint16(data[:2], infoCode)
+  copy(data[2:], extraText)
+  return ednsOption{Code: edeOptionCode, Data: data}
+}
+
+// truncateForUDP drops answers from the end of response until it fits
+// within maxSize bytes, setting TC=1 if anything had to be dropped, per
+// RFC 6891's negotiated UDP payload size (or the RFC 1035 512-byte
+// default when the requester sent no OPT record).
+func truncateForUDP(response DNSMessage, maxSize int) DNSMessage {
+  if len(response.serialize()) <= maxSize {
+    return response
+  }
+
+  response.TC = 1
+  for len(response.Answer) > 0 && len(response.serialize()) > maxSize {
+    response.Answer = response.Answer[:len(response.Answer)-1]
+  }
+  return response
+}
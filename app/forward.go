@@ -0,0 +1,229 @@
+package main
+
+import (
+  "fmt"
+  "net"
+  "sync"
+  "time"
+)
+
+// maxInFlightUpstreamQueries bounds how many outstanding queries a single
+// upstreamClient will have in flight at once, so a flood of questions
+// can't exhaust the transaction ID space or the upstream's patience.
+const maxInFlightUpstreamQueries = 64
+
+// maxUpstreamAttempts is how many times a query is retried (over the
+// same shared socket) before it's given up on.
+const maxUpstreamAttempts = 2
+
+// upstreamClient multiplexes concurrent queries to a single upstream
+// resolver over one shared UDP socket, matching replies back to their
+// waiting caller by DNS transaction ID.
+type upstreamClient struct {
+  addr string
+  timeout time.Duration
+
+  conn *net.UDPConn
+  sem chan struct{}
+
+  mu sync.Mutex
+  nextID uint16
+  pending map[uint16]chan DNSMessage
+}
+
+func newUpstreamClient(addr string, timeout time.Duration) (*upstreamClient, error) {
+  udpAddr, err := net.ResolveUDPAddr("udp", addr)
+  if err != nil {
+    return nil, err
+  }
+
+  conn, err := net.DialUDP("udp", nil, udpAddr)
+  if err != nil {
+    return nil, err
+  }
+
+  c := &upstreamClient{
+    addr: addr,
+    timeout: timeout,
+    conn: conn,
+    sem: make(chan struct{}, maxInFlightUpstreamQueries),
+    pending: make(map[uint16]chan DNSMessage),
+  }
+  go c.readLoop()
+  return c, nil
+}
+
+// readLoop dispatches every reply read off the shared socket to whichever
+// caller is waiting on its transaction ID, discarding anything else (a
+// stale retry reply, or noise on the socket).
+func (c *upstreamClient) readLoop() {
+  buf := make([]byte, 65535)
+  for {
+    n, err := c.conn.Read(buf)
+    if err != nil {
+      return
+    }
+
+    msg, err := parseDNSMessage(buf[:n])
+    if err != nil {
+      continue
+    }
+
+    c.mu.Lock()
+    waiter, ok := c.pending[msg.ID]
+    c.mu.Unlock()
+
+    if ok {
+      waiter <- msg
+    }
+  }
+}
+
+func (c *upstreamClient) allocID() uint16 {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.nextID++
+  return c.nextID
+}
+
+// query sends req upstream over the shared socket and waits for the
+// matching reply, retrying up to maxUpstreamAttempts times on timeout,
+// then falling back to TCP if the reply comes back truncated.
+func (c *upstreamClient) query(req DNSMessage) (DNSMessage, error) {
+  c.sem <- struct{}{}
+  defer func() { <-c.sem }()
+
+  id := c.allocID()
+  req.Header.ID = id
+
+  waiter := make(chan DNSMessage, 1)
+  c.mu.Lock()
+  c.pending[id] = waiter
+  c.mu.Unlock()
+  defer func() {
+    c.mu.Lock()
+    delete(c.pending, id)
+    c.mu.Unlock()
+  }()
+
+  payload := req.serialize()
+
+  for attempt := 0; attempt < maxUpstreamAttempts; attempt++ {
+    if _, err := c.conn.Write(payload); err != nil {
+      return DNSMessage{}, err
+    }
+
+    select {
+    case resp := <-waiter:
+      if resp.TC == 1 {
+        return forwardQuestionTCP(req, c.addr)
+      }
+      return resp, nil
+    case <-time.After(c.timeout):
+    }
+  }
+
+  return DNSMessage{}, fmt.Errorf("upstream query %d timed out after %d attempts", id, maxUpstreamAttempts)
+}
+
+// forward fans the request's questions out to the upstream resolver in
+// parallel (skipping any that are already cached) and stitches the
+// answers back into a single response.
+func forward(dnsRequest DNSMessage, client *upstreamClient, rrCache *cache) DNSMessage {
+  response := generateResponse(dnsRequest)
+  response.Answer = []RR{}
+
+  answers := make([][]RR, len(dnsRequest.Questions))
+  var wg sync.WaitGroup
+  var mu sync.Mutex
+  for i, reqQ := range(dnsRequest.Questions) {
+    if rrCache != nil {
+      if rrs, rcode, ok := rrCache.get(reqQ); ok {
+        if rcode != 0 {
+          response.RCODE = rcode
+        } else {
+          answers[i] = rrs
+        }
+        continue
+      }
+    }
+
+    wg.Add(1)
+    go func(i int, reqQ Question) {
+      defer wg.Done()
+      req := generateRequest(dnsRequest, reqQ)
+      dnsResponse, err := client.query(req)
+      if err != nil {
+        mu.Lock()
+        response.RCODE = rcodeServFail
+        if dnsRequest.EDNS != nil {
+          if response.EDNS == nil {
+            response.EDNS = &EDNS0{}
+          }
+          response.EDNS.Options = append(response.EDNS.Options, newEDEOption(ednsInfoCodeNetworkError, err.Error()))
+        }
+        mu.Unlock()
+        return
+      }
+
+      if rrCache != nil {
+        cacheUpstreamResponse(rrCache, reqQ, dnsResponse)
+      }
+
+      if dnsResponse.RCODE != 0 {
+        mu.Lock()
+        response.RCODE = dnsResponse.RCODE
+        mu.Unlock()
+        return
+      }
+      answers[i] = dnsResponse.Answer
+    }(i, reqQ)
+  }
+  wg.Wait()
+
+  for _, rrs := range(answers) {
+    response.Answer = append(response.Answer, rrs...)
+  }
+  response.Header.ANCOUNT = uint16(len(response.Answer))
+  return response
+}
+
+// cacheUpstreamResponse stores resp as the cached result for q: a
+// negative (RFC 2308) entry on NXDOMAIN using the authority section's
+// SOA MINIMUM, or the full answer set otherwise.
+func cacheUpstreamResponse(rrCache *cache, q Question, resp DNSMessage) {
+  if resp.RCODE == 3 {
+    for _, rr := range(resp.Authority) {
+      if ttl, ok := soaMinimumTTL(rr); ok {
+        rrCache.putNegative(q, resp.RCODE, ttl)
+        return
+      }
+    }
+    return
+  }
+  if len(resp.Answer) > 0 {
+    rrCache.putPositive(q, resp.Answer)
+  }
+}
+
+// forwardQuestionTCP sends req to the upstream resolver over TCP, used as
+// the truncation-retry path for both the plain TCP listener and the
+// upstreamClient's UDP truncation fallback.
+func forwardQuestionTCP(req DNSMessage, resolverAddr string) (DNSMessage, error) {
+  conn, err := net.Dial("tcp", resolverAddr)
+  if err != nil {
+    return DNSMessage{}, err
+  }
+  defer conn.Close()
+
+  if err := writeTCPMessage(conn, req.serialize()); err != nil {
+    return DNSMessage{}, err
+  }
+
+  msg, err := readTCPMessage(conn)
+  if err != nil {
+    return DNSMessage{}, err
+  }
+
+  return parseDNSMessage(msg)
+}
@@ -8,12 +8,16 @@ import (
 	"io"
 	"net"
 	"strings"
+	"time"
 )
 
 type DNSMessage struct {
   Header
   Questions []Question
   Answer []RR
+  Authority []RR
+  Additional []RR
+  EDNS *EDNS0
 }
 
 type Header struct {
@@ -43,18 +47,16 @@ type RR struct {
   Type uint16
   Class uint16
   TTL uint32
-  Length uint16
-  Data []byte
+  Data RData
 }
 
 func newRR(name string) RR {
   return RR {
     Name: name,
-    Type: 1,
+    Type: typeA,
     Class: 1,
     TTL: 60,
-    Length: 4,
-    Data: []byte("\x08\x08\x08\x08"),
+    Data: ARecord{IP: net.ParseIP("8.8.8.8")},
   }
 }
 
@@ -123,22 +125,25 @@ func generateRequest(originalRequest DNSMessage, singleQuestion Question) DNSMes
   return DNSMessage{Questions: q, Header: h, Answer: a}
 }
 
-func (q Question) serialize() []byte {
+func (q Question) serialize(ctx *compressionContext, offset int) []byte {
     buffer := new(bytes.Buffer)
-    buffer.Write(serializeDomain(q.Name))
+    buffer.Write(serializeDomain(q.Name, offset, ctx))
     binary.Write(buffer, binary.BigEndian, q.Type)
     binary.Write(buffer, binary.BigEndian, q.Class)
     return buffer.Bytes()
 }
 
-func (r RR) serialize() []byte {
+func (r RR) serialize(ctx *compressionContext, offset int) []byte {
     buffer := new(bytes.Buffer)
-    buffer.Write(serializeDomain(r.Name))
+    buffer.Write(serializeDomain(r.Name, offset, ctx))
     binary.Write(buffer, binary.BigEndian, r.Type)
     binary.Write(buffer, binary.BigEndian, r.Class)
     binary.Write(buffer, binary.BigEndian, r.TTL)
-    binary.Write(buffer, binary.BigEndian, uint16(len(r.Data)))
-    buffer.Write(r.Data)
+
+    // +2 for the RDLENGTH field that precedes the RDATA itself.
+    rdata := r.Data.serialize(ctx, offset+buffer.Len()+2)
+    binary.Write(buffer, binary.BigEndian, uint16(len(rdata)))
+    buffer.Write(rdata)
     return buffer.Bytes()
 }
 
@@ -154,25 +159,58 @@ func (h Header) serialize() []byte {
 	return buffer
 }
 
-func serializeDomain(domain string) []byte {
-  buffer := []byte{}
-  labels := strings.Split(domain, ".")
-  for _, label := range(labels) {
-    buffer = append(buffer, byte(len(label)))
-    buffer = append(buffer, []byte(label)...)
+// serializeDomain writes domain as a sequence of length-prefixed labels,
+// compressing the longest already-written suffix into a pointer per
+// RFC 1035 section 4.1.4. offset is the position of this name within the
+// message being built, used both to emit pointers and to record this
+// name's own suffixes for later reuse.
+func serializeDomain(domain string, offset int, ctx *compressionContext) []byte {
+  if domain == "" {
+    return []byte{0x00}
+  }
+
+  if ptr, ok := ctx.lookup(domain); ok {
+    return []byte{byte(0xC0 | (ptr >> 8)), byte(ptr)}
+  }
+
+  label, rest, _ := strings.Cut(domain, ".")
+  buffer := []byte{byte(len(label))}
+  buffer = append(buffer, []byte(label)...)
+
+  if offset <= 0x3FFF {
+    ctx.record(domain, offset)
   }
-  buffer = append(buffer, '\x00')
+
+  buffer = append(buffer, serializeDomain(rest, offset+len(buffer), ctx)...)
   return buffer
 }
 
 func (m DNSMessage) serialize() []byte {
+  additional := m.Additional
+  if m.EDNS != nil {
+    additional = append(append([]RR{}, additional...), m.EDNS.rr())
+  }
+
+  header := m.Header
+  header.QDCOUNT = uint16(len(m.Questions))
+  header.ANCOUNT = uint16(len(m.Answer))
+  header.NSCOUNT = uint16(len(m.Authority))
+  header.ARCOUNT = uint16(len(additional))
+
   buffer := new(bytes.Buffer)
-  buffer.Write(m.Header.serialize())
+  buffer.Write(header.serialize())
+  ctx := newCompressionContext()
   for _, q := range(m.Questions) {
-    buffer.Write(q.serialize())
+    buffer.Write(q.serialize(ctx, buffer.Len()))
   }
   for _, r := range(m.Answer) {
-    buffer.Write(r.serialize())
+    buffer.Write(r.serialize(ctx, buffer.Len()))
+  }
+  for _, r := range(m.Authority) {
+    buffer.Write(r.serialize(ctx, buffer.Len()))
+  }
+  for _, r := range(additional) {
+    buffer.Write(r.serialize(ctx, buffer.Len()))
   }
   return buffer.Bytes()
 }
@@ -208,38 +246,75 @@ func parseDNSMessage(data []byte) (DNSMessage, error) {
     }
 
     for i := 0; i < int(msg.Header.ANCOUNT); i++ {
-        var rr RR
-        rr.Name, err = readName(reader)
+        rr, err := parseRR(reader)
         if err != nil {
-            return msg, fmt.Errorf("failed to parse RR name: %v", err)
+            return msg, fmt.Errorf("failed to parse answer RR: %v", err)
         }
-        err = binary.Read(reader, binary.BigEndian, &rr.Type)
-        if err != nil {
-            return msg, fmt.Errorf("failed to parse RR type: %v", err)
-        }
-        err = binary.Read(reader, binary.BigEndian, &rr.Class)
-        if err != nil {
-            return msg, fmt.Errorf("failed to parse RR class: %v", err)
-        }
-        err = binary.Read(reader, binary.BigEndian, &rr.TTL)
+        msg.Answer = append(msg.Answer, rr)
+    }
+
+    for i := 0; i < int(msg.Header.NSCOUNT); i++ {
+        rr, err := parseRR(reader)
         if err != nil {
-            return msg, fmt.Errorf("failed to parse RR TTL: %v", err)
+            return msg, fmt.Errorf("failed to parse authority RR: %v", err)
         }
-        err = binary.Read(reader, binary.BigEndian, &rr.Length)
+        msg.Authority = append(msg.Authority, rr)
+    }
+
+    for i := 0; i < int(msg.Header.ARCOUNT); i++ {
+        rr, err := parseRR(reader)
         if err != nil {
-            return msg, fmt.Errorf("failed to parse RR data length: %v", err)
+            return msg, fmt.Errorf("failed to parse additional RR: %v", err)
         }
-        rr.Data = make([]byte, rr.Length)
-        _, err = reader.Read(rr.Data)
-        if err != nil {
-            return msg, fmt.Errorf("failed to parse RR data: %v", err)
+        if rr.Type == optRRType {
+            msg.EDNS = parseOPTRecord(rr)
+            continue
         }
-        msg.Answer = append(msg.Answer, rr)
+        msg.Additional = append(msg.Additional, rr)
     }
 
     return msg, nil
 }
 
+func parseRR(reader *bytes.Reader) (RR, error) {
+    var rr RR
+    var err error
+
+    rr.Name, err = readName(reader)
+    if err != nil {
+        return rr, fmt.Errorf("failed to parse RR name: %v", err)
+    }
+    err = binary.Read(reader, binary.BigEndian, &rr.Type)
+    if err != nil {
+        return rr, fmt.Errorf("failed to parse RR type: %v", err)
+    }
+    err = binary.Read(reader, binary.BigEndian, &rr.Class)
+    if err != nil {
+        return rr, fmt.Errorf("failed to parse RR class: %v", err)
+    }
+    err = binary.Read(reader, binary.BigEndian, &rr.TTL)
+    if err != nil {
+        return rr, fmt.Errorf("failed to parse RR TTL: %v", err)
+    }
+    var length uint16
+    err = binary.Read(reader, binary.BigEndian, &length)
+    if err != nil {
+        return rr, fmt.Errorf("failed to parse RR data length: %v", err)
+    }
+
+    rdataStart, _ := reader.Seek(0, io.SeekCurrent)
+    rr.Data, err = parseRData(reader, rr.Type, length)
+    if err != nil {
+        return rr, fmt.Errorf("failed to parse RR data: %v", err)
+    }
+    // Realign to the RDLENGTH-declared end regardless of how many bytes
+    // the type-specific parser actually consumed, so an unexpected RDATA
+    // shape can't desync the rest of the message.
+    reader.Seek(rdataStart+int64(length), io.SeekStart)
+
+    return rr, nil
+}
+
 func parseHeader(data []byte) (*Header, error) {
 	if len(data) < 12 {
 		return nil, fmt.Errorf("header too short")
@@ -284,6 +359,7 @@ func parseName(reader *bytes.Reader, offset int64) (string, error) {
             if err != nil {
                 return "", fmt.Errorf("failed to read the second part of the pointer: %v", err)
             }
+            resumeOffset, _ := reader.Seek(0, io.SeekCurrent)
             newOffset := int64(length&0x3F)<<8 + int64(offsetPart)
             // Recursively parse the name starting at the new offset
             partName, err := parseName(reader, newOffset)
@@ -291,7 +367,11 @@ func parseName(reader *bytes.Reader, offset int64) (string, error) {
                 return "", err
             }
             nameParts = append(nameParts, partName)
-            break 
+            // A pointer always ends a name; restore the reader to just
+            // past the 2-byte pointer so the caller can keep reading the
+            // rest of this record, not wherever the jump left off.
+            reader.Seek(resumeOffset, io.SeekStart)
+            break
         } else if length == 0 {
             break
         } else {
@@ -311,62 +391,42 @@ func readName(reader *bytes.Reader) (string, error) {
     return parseName(reader, currentOffset)
 }
 
-var resolverFlag = flag.String("resolver", ".", "Address of DNS server to forward to")
+var resolverFlag = flag.String("resolver", "", "Address of DNS server to forward to (empty disables forwarding)")
+var upstreamTimeoutFlag = flag.Duration("upstream-timeout", 2*time.Second, "Timeout for a single upstream query attempt")
+var cacheSizeFlag = flag.Int("cache-size", 10000, "Maximum number of cached responses (0 disables the cache)")
+var cacheTTLCapFlag = flag.Uint("cache-ttl-cap", 3600, "Maximum TTL in seconds to honor for a cached entry (0 disables the cap)")
+var zoneFlag = flag.String("zone", "", "Path to a zone file to serve authoritatively")
 
 func main() {
   flag.Parse()
 
-	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:2053")
-	if err != nil {
-		fmt.Println("Failed to resolve UDP address:", err)
-		return
-	}
+  var upstream *upstreamClient
+  var rrCache *cache
+  if *resolverFlag != "" {
+    client, err := newUpstreamClient(*resolverFlag, *upstreamTimeoutFlag)
+    if err != nil {
+      fmt.Println("Failed to connect to upstream resolver:", err)
+      return
+    }
+    upstream = client
 
-	udpConn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		fmt.Println("Failed to bind to address:", err)
-		return
-	}
-	defer udpConn.Close()
-
-	buf := make([]byte, 512)
-
-	for {
-		size, source, err := udpConn.ReadFromUDP(buf)
-		if err != nil {
-			fmt.Println("Error receiving data:", err)
-			break
-		}
-
-		dnsRequest, _ := parseDNSMessage(buf[:size])
-
-    var response DNSMessage
-    if *resolverFlag == "" {
-      response = generateResponse(dnsRequest)
-    } else {
-      addr, _ := net.ResolveUDPAddr("udp", *resolverFlag)
-      conn, _ := net.DialUDP("udp", nil, addr)
-
-      // just overwrite the answers
-      response = generateResponse(dnsRequest)
-      response.Answer = []RR{}
-      for _, reqQ := range dnsRequest.Questions {
-        req := generateRequest(dnsRequest, reqQ)
-        conn.Write(req.serialize())
-
-        buffer := make([]byte, 512)
-        conn.ReadFromUDP(buffer)
-
-        dnsResponse, _ := parseDNSMessage(buffer)
-        if len(dnsResponse.Answer) > 0 {
-          response.Answer = append(response.Answer, dnsResponse.Answer[0])
-        }
-      }
-      response.Header.ANCOUNT = uint16(len(response.Answer))
+    if *cacheSizeFlag > 0 {
+      rrCache = newCache(*cacheSizeFlag, uint32(*cacheTTLCapFlag))
     }
-    _, err = udpConn.WriteToUDP(response.serialize(), source)
+  }
+
+  var zone *Zone
+  if *zoneFlag != "" {
+    loaded, err := loadZone(*zoneFlag)
     if err != nil {
-      fmt.Println("Failed to send response:", err)
+      fmt.Println("Failed to load zone file:", err)
+      return
     }
-	}
+    zone = loaded
+  }
+
+  server := NewServer("127.0.0.1:2053", upstream, rrCache, zone)
+  if err := server.ListenAndServe(); err != nil {
+    fmt.Println("Server error:", err)
+  }
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "io"
+  "net"
+)
+
+const (
+  typeA = 1
+  typeNS = 2
+  typeCNAME = 5
+  typeSOA = 6
+  typePTR = 12
+  typeMX = 15
+  typeTXT = 16
+  typeAAAA = 28
+)
+
+// RData is an RR's type-specific record data. Implementations know how to
+// serialize themselves into a message being built, recompressing any
+// embedded domain names against the shared compressionContext.
+type RData interface {
+  serialize(ctx *compressionContext, offset int) []byte
+}
+
+// RawRecord is the RDATA for any type this server doesn't model
+// explicitly (including the EDNS0 OPT pseudo-RR); it round-trips the raw
+// bytes unchanged.
+type RawRecord struct {
+  Data []byte
+}
+
+func (r RawRecord) serialize(ctx *compressionContext, offset int) []byte {
+  return r.Data
+}
+
+type ARecord struct {
+  IP net.IP
+}
+
+func (r ARecord) serialize(ctx *compressionContext, offset int) []byte {
+  return r.IP.To4()
+}
+
+type AAAARecord struct {
+  IP net.IP
+}
+
+func (r AAAARecord) serialize(ctx *compressionContext, offset int) []byte {
+  return r.IP.To16()
+}
+
+type CNAMERecord struct {
+  Target string
+}
+
+func (r CNAMERecord) serialize(ctx *compressionContext, offset int) []byte {
+  return serializeDomain(r.Target, offset, ctx)
+}
+
+type NSRecord struct {
+  Target string
+}
+
+func (r NSRecord) serialize(ctx *compressionContext, offset int) []byte {
+  return serializeDomain(r.Target, offset, ctx)
+}
+
+type PTRRecord struct {
+  Target string
+}
+
+func (r PTRRecord) serialize(ctx *compressionContext, offset int) []byte {
+  return serializeDomain(r.Target, offset, ctx)
+}
+
+type MXRecord struct {
+  Preference uint16
+  Target string
+}
+
+func (r MXRecord) serialize(ctx *compressionContext, offset int) []byte {
+  buffer := make([]byte, 2)
+  binary.BigEndian.PutUint16(buffer, r.Preference)
+  return append(buffer, serializeDomain(r.Target, offset+len(buffer), ctx)...)
+}
+
+type TXTRecord struct {
+  Text []string
+}
+
+func (r TXTRecord) serialize(ctx *compressionContext, offset int) []byte {
+  buffer := new(bytes.Buffer)
+  for _, s := range(r.Text) {
+    buffer.WriteByte(byte(len(s)))
+    buffer.WriteString(s)
+  }
+  return buffer.Bytes()
+}
+
+type SOARecord struct {
+  MName string
+  RName string
+  Serial uint32
+  Refresh uint32
+  Retry uint32
+  Expire uint32
+  Minimum uint32
+}
+
+func (r SOARecord) serialize(ctx *compressionContext, offset int) []byte {
+  buffer := new(bytes.Buffer)
+  buffer.Write(serializeDomain(r.MName, offset, ctx))
+  buffer.Write(serializeDomain(r.RName, offset+buffer.Len(), ctx))
+  binary.Write(buffer, binary.BigEndian, r.Serial)
+  binary.Write(buffer, binary.BigEndian, r.Refresh)
+  binary.Write(buffer, binary.BigEndian, r.Retry)
+  binary.Write(buffer, binary.BigEndian, r.Expire)
+  binary.Write(buffer, binary.BigEndian, r.Minimum)
+  return buffer.Bytes()
+}
+
+// parseRData decodes the RDATA for an RR of the given type, reading
+// straight off reader so that any embedded domain name (CNAME/NS/PTR/MX/
+// SOA) can follow compression pointers anywhere earlier in the message
+// via parseName/readName.
+func parseRData(reader *bytes.Reader, rrType uint16, length uint16) (RData, error) {
+  switch rrType {
+  case typeA:
+    buf := make([]byte, 4)
+    if _, err := io.ReadFull(reader, buf); err != nil {
+      return nil, err
+    }
+    return ARecord{IP: net.IP(buf)}, nil
+
+  case typeAAAA:
+    buf := make([]byte, 16)
+    if _, err := io.ReadFull(reader, buf); err != nil {
+      return nil, err
+    }
+    return AAAARecord{IP: net.IP(buf)}, nil
+
+  case typeCNAME:
+    target, err := readName(reader)
+    if err != nil {
+      return nil, err
+    }
+    return CNAMERecord{Target: target}, nil
+
+  case typeNS:
+    target, err := readName(reader)
+    if err != nil {
+      return nil, err
+    }
+    return NSRecord{Target: target}, nil
+
+  case typePTR:
+    target, err := readName(reader)
+    if err != nil {
+      return nil, err
+    }
+    return PTRRecord{Target: target}, nil
+
+  case typeMX:
+    var preference uint16
+    if err := binary.Read(reader, binary.BigEndian, &preference); err != nil {
+      return nil, err
+    }
+    target, err := readName(reader)
+    if err != nil {
+      return nil, err
+    }
+    return MXRecord{Preference: preference, Target: target}, nil
+
+  case typeSOA:
+    mname, err := readName(reader)
+    if err != nil {
+      return nil, err
+    }
+    rname, err := readName(reader)
+    if err != nil {
+      return nil, err
+    }
+    soa := SOARecord{MName: mname, RName: rname}
+    for _, field := range([]*uint32{&soa.Serial, &soa.Refresh, &soa.Retry, &soa.Expire, &soa.Minimum}) {
+      if err := binary.Read(reader, binary.BigEndian, field); err != nil {
+        return nil, err
+      }
+    }
+    return soa, nil
+
+  case typeTXT:
+    buf := make([]byte, length)
+    if _, err := io.ReadFull(reader, buf); err != nil {
+      return nil, err
+    }
+    txtReader := bytes.NewReader(buf)
+    var texts []string
+    for txtReader.Len() > 0 {
+      segLen, err := txtReader.ReadByte()
+      if err != nil {
+        break
+      }
+      segment := make([]byte, segLen)
+      if _, err := io.ReadFull(txtReader, segment); err != nil {
+        break
+      }
+      texts = append(texts, string(segment))
+    }
+    return TXTRecord{Text: texts}, nil
+
+  default:
+    buf := make([]byte, length)
+    if _, err := io.ReadFull(reader, buf); err != nil {
+      return nil, err
+    }
+    return RawRecord{Data: buf}, nil
+  }
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+  "encoding/binary"
+  "fmt"
+  "io"
+  "net"
+)
+
+// Server runs the DNS listener concurrently over UDP and TCP, dispatching
+// every query through the same resolver/forwarding logic.
+type Server struct {
+  addr string
+  upstream *upstreamClient
+  cache *cache
+  zone *Zone
+}
+
+func NewServer(addr string, upstream *upstreamClient, rrCache *cache, zone *Zone) *Server {
+  return &Server{addr: addr, upstream: upstream, cache: rrCache, zone: zone}
+}
+
+// ListenAndServe starts the UDP and TCP listeners and blocks until either
+// one stops with an error.
+func (s *Server) ListenAndServe() error {
+  errCh := make(chan error, 2)
+  go func() { errCh <- s.serveUDP() }()
+  go func() { errCh <- s.serveTCP() }()
+  return <-errCh
+}
+
+func (s *Server) serveUDP() error {
+  udpAddr, err := net.ResolveUDPAddr("udp", s.addr)
+  if err != nil {
+    return fmt.Errorf("failed to resolve UDP address: %v", err)
+  }
+
+  udpConn, err := net.ListenUDP("udp", udpAddr)
+  if err != nil {
+    return fmt.Errorf("failed to bind UDP address: %v", err)
+  }
+  defer udpConn.Close()
+
+  buf := make([]byte, 512)
+  for {
+    size, source, err := udpConn.ReadFromUDP(buf)
+    if err != nil {
+      fmt.Println("Error receiving UDP data:", err)
+      continue
+    }
+
+    dnsRequest, _ := parseDNSMessage(buf[:size])
+    response := s.handleQuery(dnsRequest)
+    response = echoEDNS(dnsRequest, response)
+
+    maxUDPSize := 512
+    if dnsRequest.EDNS != nil && int(dnsRequest.EDNS.UDPSize) > maxUDPSize {
+      maxUDPSize = int(dnsRequest.EDNS.UDPSize)
+    }
+    response = truncateForUDP(response, maxUDPSize)
+
+    if _, err := udpConn.WriteToUDP(response.serialize(), source); err != nil {
+      fmt.Println("Failed to send UDP response:", err)
+    }
+  }
+}
+
+func (s *Server) serveTCP() error {
+  listener, err := net.Listen("tcp", s.addr)
+  if err != nil {
+    return fmt.Errorf("failed to bind TCP address: %v", err)
+  }
+  defer listener.Close()
+
+  for {
+    conn, err := listener.Accept()
+    if err != nil {
+      fmt.Println("Error accepting TCP connection:", err)
+      continue
+    }
+    go s.handleTCPConn(conn)
+  }
+}
+
+func (s *Server) handleTCPConn(conn net.Conn) {
+  defer conn.Close()
+
+  for {
+    msg, err := readTCPMessage(conn)
+    if err != nil {
+      return
+    }
+
+    dnsRequest, _ := parseDNSMessage(msg)
+    response := s.handleQuery(dnsRequest)
+    response = echoEDNS(dnsRequest, response)
+
+    if err := writeTCPMessage(conn, response.serialize()); err != nil {
+      fmt.Println("Failed to send TCP response:", err)
+      return
+    }
+  }
+}
+
+// handleQuery runs the shared resolver logic: answer authoritatively when
+// running standalone, or forward to the configured upstream resolver.
+func (s *Server) handleQuery(dnsRequest DNSMessage) DNSMessage {
+  if s.zone != nil {
+    if response, ok := s.zone.answerAuthoritatively(dnsRequest, s.resolveExternal); ok {
+      return response
+    }
+  }
+  if s.upstream == nil {
+    return generateResponse(dnsRequest)
+  }
+  return forward(dnsRequest, s.upstream, s.cache)
+}
+
+// echoEDNS attaches an OPT record to response whenever dnsRequest carried
+// one, per RFC 6891 section 6.2.1 (a server that receives an OPT record
+// should include one in the response regardless of transport), without
+// clobbering any EDNS0 a handler already set (e.g. an EDE option from a
+// forwarding failure).
+func echoEDNS(dnsRequest, response DNSMessage) DNSMessage {
+  if dnsRequest.EDNS == nil {
+    return response
+  }
+  if response.EDNS == nil {
+    response.EDNS = &EDNS0{}
+  }
+  response.EDNS.UDPSize = serverUDPPayloadSize
+  return response
+}
+
+// resolveExternal looks up a single (name, type) pair against the
+// upstream resolver. It's used by the zone's CNAME chase when a target
+// falls outside any zone this server serves authoritatively, returning
+// nil if there's no configured upstream or the lookup fails.
+func (s *Server) resolveExternal(name string, qtype uint16) []RR {
+  if s.upstream == nil {
+    return nil
+  }
+
+  req := DNSMessage{Header: Header{RD: 1}, Questions: []Question{{Name: name, Type: qtype, Class: 1}}}
+  resp, err := s.upstream.query(req)
+  if err != nil {
+    return nil
+  }
+  return resp.Answer
+}
+
+// readTCPMessage reads one length-prefixed DNS message (RFC 1035 section
+// 4.2.2) from conn.
+func readTCPMessage(conn net.Conn) ([]byte, error) {
+  var length uint16
+  if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+    return nil, err
+  }
+  buf := make([]byte, length)
+  if _, err := io.ReadFull(conn, buf); err != nil {
+    return nil, err
+  }
+  return buf, nil
+}
+
+// writeTCPMessage writes msg to conn prefixed with its 2-byte length.
+func writeTCPMessage(conn net.Conn, msg []byte) error {
+  length := make([]byte, 2)
+  binary.BigEndian.PutUint16(length, uint16(len(msg)))
+  if _, err := conn.Write(length); err != nil {
+    return err
+  }
+  _, err := conn.Write(msg)
+  return err
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+  "bufio"
+  "fmt"
+  "net"
+  "os"
+  "strconv"
+  "strings"
+)
+
+// zoneRecord is one resource record parsed from a zone file, keyed by its
+// owner name within the zone.
+type zoneRecord struct {
+  Name string
+  Type uint16
+  TTL uint32
+  Data RData
+}
+
+// zoneNode is a trie node keyed by reversed domain labels (so
+// "www.example.com" is reached root -> "com" -> "example" -> "www"),
+// which makes "is this name served, and by which zone apex" a cheap
+// longest-suffix walk instead of a linear scan of every record.
+type zoneNode struct {
+  children map[string]*zoneNode
+  records []zoneRecord
+  soa *SOARecord
+  soaOwner string
+}
+
+func newZoneNode() *zoneNode {
+  return &zoneNode{children: make(map[string]*zoneNode)}
+}
+
+// Zone is a set of authoritative records loaded from a master file,
+// possibly spanning more than one $ORIGIN.
+type Zone struct {
+  root *zoneNode
+}
+
+func reversedLabels(name string) []string {
+  if name == "" {
+    return nil
+  }
+  labels := strings.Split(strings.ToLower(name), ".")
+  reversed := make([]string, len(labels))
+  for i, label := range(labels) {
+    reversed[len(labels)-1-i] = label
+  }
+  return reversed
+}
+
+func (z *Zone) insert(record zoneRecord) {
+  node := z.root
+  for _, label := range(reversedLabels(record.Name)) {
+    child, ok := node.children[label]
+    if !ok {
+      child = newZoneNode()
+      node.children[label] = child
+    }
+    node = child
+  }
+
+  if record.Type == typeSOA {
+    soa := record.Data.(SOARecord)
+    node.soa = &soa
+    node.soaOwner = record.Name
+  }
+  node.records = append(node.records, record)
+}
+
+// lookup walks name's labels against the trie, returning the records at
+// an exact match (exact=true), along with the SOA (and its owner name)
+// of the nearest enclosing zone apex seen along the way. A nil soa means
+// name isn't covered by any zone this Zone loaded.
+func (z *Zone) lookup(name string) (records []zoneRecord, soa *SOARecord, soaOwner string, exact bool) {
+  labels := reversedLabels(name)
+  node := z.root
+  if node.soa != nil {
+    soa, soaOwner = node.soa, node.soaOwner
+  }
+
+  for i, label := range(labels) {
+    child, ok := node.children[label]
+    if !ok {
+      return nil, soa, soaOwner, false
+    }
+    node = child
+    if node.soa != nil {
+      soa, soaOwner = node.soa, node.soaOwner
+    }
+    if i == len(labels)-1 {
+      return node.records, soa, soaOwner, true
+    }
+  }
+  return node.records, soa, soaOwner, true
+}
+
+// maxZoneCNAMEChain bounds how many CNAMEs answerAuthoritatively will
+// follow in-zone for a single question, guarding against a cyclic chain
+// in a misconfigured zone file.
+const maxZoneCNAMEChain = 8
+
+// answerAuthoritatively answers dnsRequest's questions from the zone,
+// setting AA=1 and synthesizing NXDOMAIN/NODATA responses with the
+// zone's SOA in the authority section when a question falls within a
+// served origin but has no matching records. A name whose only record is
+// a CNAME is followed per RFC 1034 section 3.6.2: the CNAME is returned
+// and, if its target is also in-zone, resolution continues there; if the
+// chain leads outside any zone this Zone loaded, resolveExternal (if
+// non-nil) is asked to resolve the remainder, e.g. against an upstream
+// resolver. ok is false when none of the request's questions are covered
+// by any zone this Zone loaded, in which case the caller should fall
+// back to the upstream resolver entirely.
+func (z *Zone) answerAuthoritatively(dnsRequest DNSMessage, resolveExternal func(name string, qtype uint16) []RR) (response DNSMessage, ok bool) {
+  response = generateResponse(dnsRequest)
+  response.Answer = nil
+
+  for _, q := range(dnsRequest.Questions) {
+    name := q.Name
+    records, soa, soaOwner, exact := z.lookup(name)
+    if soa == nil {
+      continue
+    }
+    ok = true
+    response.AA = 1
+
+    var answer []RR
+    for depth := 0; depth < maxZoneCNAMEChain; depth++ {
+      var matched []RR
+      var cname *zoneRecord
+      for i := range(records) {
+        r := records[i]
+        if r.Type == q.Type {
+          matched = append(matched, RR{Name: name, Type: r.Type, Class: 1, TTL: r.TTL, Data: r.Data})
+        } else if r.Type == typeCNAME {
+          cname = &records[i]
+        }
+      }
+
+      if len(matched) > 0 {
+        answer = append(answer, matched...)
+        break
+      }
+
+      if cname == nil || q.Type == typeCNAME {
+        break
+      }
+      answer = append(answer, RR{Name: name, Type: typeCNAME, Class: 1, TTL: cname.TTL, Data: cname.Data})
+
+      target := cname.Data.(CNAMERecord).Target
+      nextRecords, nextSOA, nextSOAOwner, nextExact := z.lookup(target)
+      if nextSOA == nil {
+        if resolveExternal != nil {
+          answer = append(answer, resolveExternal(target, q.Type)...)
+        }
+        break
+      }
+      name, records, exact = target, nextRecords, nextExact
+      soa, soaOwner = nextSOA, nextSOAOwner
+    }
+
+    if len(answer) > 0 {
+      response.Answer = append(response.Answer, answer...)
+      continue
+    }
+
+    if !exact {
+      response.RCODE = 3 // NXDOMAIN: the zone exists but this name doesn't
+    }
+    response.Authority = append(response.Authority, RR{Name: soaOwner, Type: typeSOA, Class: 1, TTL: soa.Minimum, Data: *soa})
+  }
+
+  if !ok {
+    return DNSMessage{}, false
+  }
+
+  response.Header.ANCOUNT = uint16(len(response.Answer))
+  response.Header.NSCOUNT = uint16(len(response.Authority))
+  return response, true
+}
+
+// loadZone parses an RFC 1035 master-file format zone file into a Zone.
+// It supports $ORIGIN/$TTL directives, "(" / ")" line continuations,
+// comments starting with ";", and owner-name elision (a record line with
+// no owner reuses the previous one).
+func loadZone(path string) (*Zone, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+
+  zone := &Zone{root: newZoneNode()}
+  var origin string
+  var defaultTTL uint32 = 3600
+  var lastOwner string
+
+  var pending strings.Builder
+  depth := 0
+
+  scanner := bufio.NewScanner(f)
+  for scanner.Scan() {
+    line := stripZoneComment(scanner.Text())
+    if strings.TrimSpace(line) == "" && depth == 0 {
+      continue
+    }
+
+    depth += strings.Count(line, "(") - strings.Count(line, ")")
+    pending.WriteString(strings.NewReplacer("(", " ", ")", " ").Replace(line))
+    pending.WriteString(" ")
+    if depth > 0 {
+      continue
+    }
+
+    entry := strings.TrimSpace(pending.String())
+    pending.Reset()
+    if entry == "" {
+      continue
+    }
+
+    if err := zone.parseZoneLine(entry, &origin, &defaultTTL, &lastOwner); err != nil {
+      return nil, err
+    }
+  }
+  if err := scanner.Err(); err != nil {
+    return nil, err
+  }
+
+  return zone, nil
+}
+
+func stripZoneComment(line string) string {
+  if i := strings.Index(line, ";"); i >= 0 {
+    return line[:i]
+  }
+  return line
+}
+
+func (z *Zone) parseZoneLine(entry string, origin *string, defaultTTL *uint32, lastOwner *string) error {
+  fields := strings.Fields(entry)
+  if len(fields) == 0 {
+    return nil
+  }
+
+  switch fields[0] {
+  case "$ORIGIN":
+    if len(fields) < 2 {
+      return fmt.Errorf("zone: $ORIGIN missing argument")
+    }
+    *origin = normalizeZoneName(fields[1], *origin)
+    return nil
+  case "$TTL":
+    if len(fields) < 2 {
+      return fmt.Errorf("zone: $TTL missing argument")
+    }
+    ttl, err := strconv.ParseUint(fields[1], 10, 32)
+    if err != nil {
+      return fmt.Errorf("zone: invalid $TTL %q: %v", fields[1], err)
+    }
+    *defaultTTL = uint32(ttl)
+    return nil
+  }
+
+  owner := *lastOwner
+  if !isZoneOwnerOmitted(fields[0]) {
+    if fields[0] == "@" {
+      owner = *origin
+    } else {
+      owner = normalizeZoneName(fields[0], *origin)
+    }
+    fields = fields[1:]
+  }
+  *lastOwner = owner
+
+  ttl := *defaultTTL
+  for len(fields) > 0 {
+    if n, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+      ttl = uint32(n)
+      fields = fields[1:]
+      continue
+    }
+    if strings.EqualFold(fields[0], "IN") {
+      fields = fields[1:]
+      continue
+    }
+    break
+  }
+
+  if len(fields) == 0 {
+    return fmt.Errorf("zone: record for %q missing a type", owner)
+  }
+  recordType := strings.ToUpper(fields[0])
+
+  data, rrType, err := parseZoneRData(recordType, fields[1:], *origin)
+  if err != nil {
+    return fmt.Errorf("zone: %s %s: %v", owner, recordType, err)
+  }
+
+  z.insert(zoneRecord{Name: owner, Type: rrType, TTL: ttl, Data: data})
+  return nil
+}
+
+// isZoneOwnerOmitted reports whether token looks like it belongs to the
+// TTL/class/type portion of a record line rather than being an owner
+// name, so a record line with an elided owner can be told apart from one
+// that spells it out.
+func isZoneOwnerOmitted(token string) bool {
+  if strings.EqualFold(token, "IN") {
+    return true
+  }
+  if _, err := strconv.ParseUint(token, 10, 32); err == nil {
+    return true
+  }
+  switch strings.ToUpper(token) {
+  case "A", "AAAA", "CNAME", "MX", "TXT", "NS", "SOA":
+    return true
+  }
+  return false
+}
+
+// normalizeZoneName resolves a zone-file name to this server's internal,
+// always-absolute, no-trailing-dot representation: names ending in "."
+// are already absolute, "@" means origin (handled by the caller), and
+// anything else is relative to origin.
+func normalizeZoneName(name, origin string) string {
+  if strings.HasSuffix(name, ".") {
+    return strings.TrimSuffix(name, ".")
+  }
+  if name == "" {
+    return origin
+  }
+  if origin == "" {
+    return name
+  }
+  return name + "." + origin
+}
+
+func parseZoneRData(recordType string, fields []string, origin string) (RData, uint16, error) {
+  switch recordType {
+  case "A":
+    if len(fields) != 1 {
+      return nil, 0, fmt.Errorf("wants exactly one address")
+    }
+    ip := net.ParseIP(fields[0])
+    if ip == nil || ip.To4() == nil {
+      return nil, 0, fmt.Errorf("invalid IPv4 address %q", fields[0])
+    }
+    return ARecord{IP: ip}, typeA, nil
+
+  case "AAAA":
+    if len(fields) != 1 {
+      return nil, 0, fmt.Errorf("wants exactly one address")
+    }
+    ip := net.ParseIP(fields[0])
+    if ip == nil {
+      return nil, 0, fmt.Errorf("invalid IPv6 address %q", fields[0])
+    }
+    return AAAARecord{IP: ip}, typeAAAA, nil
+
+  case "CNAME":
+    if len(fields) != 1 {
+      return nil, 0, fmt.Errorf("wants exactly one target")
+    }
+    return CNAMERecord{Target: normalizeZoneName(fields[0], origin)}, typeCNAME, nil
+
+  case "NS":
+    if len(fields) != 1 {
+      return nil, 0, fmt.Errorf("wants exactly one target")
+    }
+    return NSRecord{Target: normalizeZoneName(fields[0], origin)}, typeNS, nil
+
+  case "MX":
+    if len(fields) != 2 {
+      return nil, 0, fmt.Errorf("wants a preference and a target")
+    }
+    preference, err := strconv.ParseUint(fields[0], 10, 16)
+    if err != nil {
+      return nil, 0, fmt.Errorf("invalid preference %q", fields[0])
+    }
+    return MXRecord{Preference: uint16(preference), Target: normalizeZoneName(fields[1], origin)}, typeMX, nil
+
+  case "TXT":
+    if len(fields) == 0 {
+      return nil, 0, fmt.Errorf("wants at least one string")
+    }
+    text := strings.Trim(strings.Join(fields, " "), "\"")
+    return TXTRecord{Text: []string{text}}, typeTXT, nil
+
+  case "SOA":
+    if len(fields) != 7 {
+      return nil, 0, fmt.Errorf("wants mname, rname and 5 timer fields, got %d fields", len(fields))
+    }
+    var timers [5]uint32
+    for i := 0; i < 5; i++ {
+      n, err := strconv.ParseUint(fields[2+i], 10, 32)
+      if err != nil {
+        return nil, 0, fmt.Errorf("invalid timer field %q: %v", fields[2+i], err)
+      }
+      timers[i] = uint32(n)
+    }
+    return SOARecord{
+      MName: normalizeZoneName(fields[0], origin),
+      RName: normalizeZoneName(fields[1], origin),
+      Serial: timers[0],
+      Refresh: timers[1],
+      Retry: timers[2],
+      Expire: timers[3],
+      Minimum: timers[4],
+    }, typeSOA, nil
+
+  default:
+    return nil, 0, fmt.Errorf("unsupported zone record type %q", recordType)
+  }
+}